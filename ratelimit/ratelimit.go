@@ -0,0 +1,126 @@
+// Package ratelimit provides a small token-bucket rate limiter in the
+// spirit of golang.org/x/time/rate, trimmed down to what cracklord needs:
+// a shared abstraction any subsystem (AddTask today, status polling
+// tomorrow) can use to decide "allow now" vs. "back off until X".
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter allows up to Rate events per second, with Burst events allowed to
+// happen back to back before the bucket has to start refilling.
+type Limiter struct {
+	sync.Mutex
+	rate     float64 // tokens added per second
+	burst    float64 // maximum bucket size
+	tokens   float64 // tokens currently available
+	lastFill time.Time
+	now      func() time.Time
+}
+
+// NewLimiter creates a Limiter that allows ratePerSecond events per second,
+// with up to burst events permitted in a single instant.
+func NewLimiter(ratePerSecond float64, burst int) *Limiter {
+	return &Limiter{
+		rate:     ratePerSecond,
+		burst:    float64(burst),
+		tokens:   float64(burst),
+		lastFill: time.Now(),
+		now:      time.Now,
+	}
+}
+
+// Allow reports whether a single event may proceed right now, consuming a
+// token if so.
+func (l *Limiter) Allow() bool {
+	ok, _ := l.reserve(1)
+	return ok
+}
+
+// Reserve reports whether a single event may proceed right now. If not, it
+// also returns how long the caller should wait before trying again.
+func (l *Limiter) Reserve() (bool, time.Duration) {
+	return l.reserve(1)
+}
+
+func (l *Limiter) reserve(n float64) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.fill()
+
+	if l.tokens >= n {
+		l.tokens -= n
+		return true, 0
+	}
+
+	if l.rate <= 0 {
+		// A zero (or misconfigured negative) rate means the bucket never
+		// refills, so there is no finite wait that would ever help; say so
+		// instead of dividing by zero and handing the caller a garbage
+		// RetryAfter.
+		return false, time.Duration(math.MaxInt64)
+	}
+
+	shortfall := n - l.tokens
+	wait := time.Duration(shortfall/l.rate*float64(time.Second)) + time.Millisecond
+
+	return false, wait
+}
+
+// fill tops up the bucket based on how much time has passed since the last
+// call. Callers must hold l.Lock.
+func (l *Limiter) fill() {
+	now := l.now()
+	elapsed := now.Sub(l.lastFill).Seconds()
+	l.lastFill = now
+
+	l.tokens += elapsed * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// Semaphore is a counting semaphore used to cap how many concurrent
+// operations a single resource (a tool, a piece of hardware) may run.
+type Semaphore struct {
+	slots chan struct{}
+}
+
+// NewSemaphore creates a Semaphore that allows up to max concurrent
+// acquisitions. max <= 0 means unlimited.
+func NewSemaphore(max int) *Semaphore {
+	if max <= 0 {
+		return nil
+	}
+
+	return &Semaphore{slots: make(chan struct{}, max)}
+}
+
+// TryAcquire attempts to take a slot without blocking, reporting whether it
+// succeeded. A nil Semaphore is treated as unlimited and always succeeds.
+func (s *Semaphore) TryAcquire() bool {
+	if s == nil {
+		return true
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release gives back a slot previously taken with TryAcquire. It is a
+// no-op on a nil Semaphore.
+func (s *Semaphore) Release() {
+	if s == nil {
+		return
+	}
+
+	<-s.slots
+}
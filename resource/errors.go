@@ -0,0 +1,27 @@
+package resource
+
+import "time"
+
+// ErrResourceBusy is returned by AddTask when the resource cannot start a
+// task right now because a concurrency or rate limit is saturated. The
+// master queue should back off and retry after RetryAfter rather than
+// hammering the resource.
+type ErrResourceBusy struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *ErrResourceBusy) Error() string {
+	return e.Reason
+}
+
+// ErrUnknownJob is returned by the task-level RPCs (TaskStatus, TaskPause,
+// TaskRun, TaskQuit) when the caller's job UUID isn't on the stack, instead
+// of silently falling through to a nil-map dereference.
+type ErrUnknownJob struct {
+	UUID string
+}
+
+func (e *ErrUnknownJob) Error() string {
+	return "No task with UUID " + e.UUID + " exists on this resource."
+}
@@ -0,0 +1,83 @@
+package resource
+
+import (
+	"github.com/jmmcatee/cracklord/common"
+	"sync"
+)
+
+// eventEmitter is an optional extension of common.Tooler. A tool whose
+// running tasks want to publish their own progress/stdout/stderr events
+// into the queue's eventHub -- not just the added/started/paused/finished/
+// failed lifecycle events the queue publishes on their behalf -- implements
+// NewTaskWithEvents instead of relying on plain NewTask. AddTask checks for
+// it with a type assertion, so tools that have no mid-run events to emit
+// are unaffected.
+type eventEmitter interface {
+	NewTaskWithEvents(job common.Job, emit func(common.TaskEvent)) (common.Tasker, error)
+}
+
+// eventHub fans lifecycle events for a job out to every subscriber that has
+// called TaskEvents for it. It replaces polling TaskStatus in a loop: a
+// Tasker (or the queue itself) pushes an event once, and every interested
+// master picks it up on its own schedule.
+type eventHub struct {
+	sync.Mutex
+	subs map[string]map[chan common.TaskEvent]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		subs: map[string]map[chan common.TaskEvent]struct{}{},
+	}
+}
+
+// subscribe registers a new channel for events on jobUUID. The channel is
+// buffered so a burst of events (e.g. stdout lines) doesn't stall whoever
+// is emitting them while a master is slow to read.
+func (h *eventHub) subscribe(jobUUID string) chan common.TaskEvent {
+	h.Lock()
+	defer h.Unlock()
+
+	ch := make(chan common.TaskEvent, 64)
+
+	if h.subs[jobUUID] == nil {
+		h.subs[jobUUID] = map[chan common.TaskEvent]struct{}{}
+	}
+	h.subs[jobUUID][ch] = struct{}{}
+
+	return ch
+}
+
+// unsubscribe removes and closes a channel previously returned by
+// subscribe. Safe to call more than once.
+func (h *eventHub) unsubscribe(jobUUID string, ch chan common.TaskEvent) {
+	h.Lock()
+	defer h.Unlock()
+
+	if subs, ok := h.subs[jobUUID]; ok {
+		if _, ok := subs[ch]; ok {
+			delete(subs, ch)
+			close(ch)
+		}
+		if len(subs) == 0 {
+			delete(h.subs, jobUUID)
+		}
+	}
+}
+
+// publish pushes evt to every live subscriber of jobUUID. A subscriber
+// whose buffer is full is assumed to be gone (disconnected master) and is
+// dropped and GC'd rather than allowed to block the publisher.
+func (h *eventHub) publish(jobUUID string, evt common.TaskEvent) {
+	h.Lock()
+	defer h.Unlock()
+
+	for ch := range h.subs[jobUUID] {
+		select {
+		case ch <- evt:
+		default:
+			delete(h.subs[jobUUID], ch)
+			close(ch)
+		}
+	}
+}
@@ -2,45 +2,96 @@ package resource
 
 import (
 	"code.google.com/p/go-uuid/uuid"
+	"crypto/tls"
 	"errors"
+	"github.com/Sirupsen/logrus"
 	"github.com/jmmcatee/cracklord/common"
-	"log"
+	"github.com/jmmcatee/cracklord/ratelimit"
 	"net"
 	"net/rpc"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 )
 
 // TODO: Add function for adding tools and assign a UUID
 
 const (
-	ERROR_AUTH    = "Call to resource did not have the proper authentication token."
+	ERROR_AUTH    = "Call was not authorized for the job UUID it specified."
 	ERROR_NO_TOOL = "Tool specified does not exit."
+	ERROR_LEAVING = "This resource is leaving and is no longer accepting new tasks."
 )
 
-// This will need to be called with a WaitGroup to handle other calls without
-// the program closing. A channel is provied to alert when the RPC server is done.
-// This can be used to quit the application or simply restart the server for the next
-// master to connect.
-func StartResource(addr string, q *Queue) chan bool {
+// DefaultDrainTimeout is how long a resource will wait for its jobs to be
+// quit off the stack before quitting anyway once it starts leaving.
+const DefaultDrainTimeout = 5 * time.Minute
+
+// errRecoveredJob is returned by a recoveredTasker for any call that would
+// otherwise try to control a tool process we no longer have a handle on.
+var errRecoveredJob = errors.New("This job was recovered from the write-ahead log after a restart and can no longer be controlled.")
+
+// StartResource starts the resource's RPC server and keeps it running
+// across however many master connections come and go: a master reconnecting
+// after a network blip does not kill the resource. The server keeps
+// accepting and serving connections sequentially until either a master
+// calls Queue.Leave or the process receives SIGINT/SIGTERM, at which point
+// it drains any running jobs (see Queue.beginLeave), stops the listener and
+// signals the returned channel so the caller can exit cleanly.
+//
+// tlsConfig, when non-nil, is used to listen with mutual TLS instead of a
+// plain TCP socket: it should set ClientCAs and ClientAuth to
+// tls.RequireAndVerifyClientCert so only masters holding a certificate
+// signed by the pinned CA can ever open a connection. A nil tlsConfig is
+// only suitable for local development.
+func StartResource(addr string, q *Queue, tlsConfig *tls.Config) chan bool {
 	res := rpc.NewServer()
 	res.Register(q)
 
-	l, err := net.Listen("tcp", addr)
+	var l net.Listener
+	var err error
+	if tlsConfig != nil {
+		l, err = tls.Listen("tcp", addr, tlsConfig)
+	} else {
+		l, err = net.Listen("tcp", addr)
+	}
 	if err != nil {
-		log.Fatal(err)
+		logrus.WithError(err).WithField("remote_addr", addr).Fatal("Failed to start resource listener")
 	}
 
+	q.left = make(chan struct{})
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		q.beginLeave()
+	}()
+
+	// Once draining finishes (or there was nothing to drain) stop the
+	// listener so the accept loop below falls out and reports quit.
+	go func() {
+		<-q.left
+		l.Close()
+	}()
+
 	quit := make(chan bool)
 	go func() {
-		// Accept and server a limited number of times
-		conn, err := l.Accept()
-		if err != nil {
-			log.Fatal(err)
-		}
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				// Listener was closed by the drain goroutine above.
+				break
+			}
 
-		res.ServeConn(conn)
+			logrus.WithField("remote_addr", conn.RemoteAddr()).Info("Master connected")
+
+			res.ServeConn(conn)
+
+			logrus.WithField("remote_addr", conn.RemoteAddr()).Info("Master disconnected")
+		}
 
-		l.Close()
 		quit <- true
 	}()
 
@@ -51,17 +102,89 @@ type Queue struct {
 	stack map[string]common.Tasker
 	tools []common.Tooler
 	sync.RWMutex
-	authToken string
-	hardware  map[string]bool
+	tokens           *TokenStore
+	hardware         map[string]bool
+	wal              *WAL
+	leaving          bool
+	drainTimeout     time.Duration
+	left             chan struct{}
+	addTaskLimiter   *ratelimit.Limiter
+	toolSlots        map[string]*ratelimit.Semaphore // keyed by tool UUID
+	hardwareSlots    map[string]*ratelimit.Semaphore // keyed by tooler.Requirements()
+	hardwareCapacity map[string]int                  // keyed by tooler.Requirements(), see SetHardwareCapacity
+	jobSlots         map[string]func()               // keyed by job UUID, releases toolSlots/hardwareSlots
+	events           *eventHub
+	retries          *retryState
 }
 
-func NewResourceQueue(token string) Queue {
-	return Queue{
-		stack:     map[string]common.Tasker{},
-		tools:     []common.Tooler{},
-		authToken: token,
-		hardware:  map[string]bool{},
+// NewResourceQueue creates a Queue ready to accept tasks. stateDir holds the
+// queue's write-ahead log; on startup any entries left over from a previous
+// run are replayed so jobs that were in flight when the process last exited
+// are not simply forgotten (still-running tool processes cannot be
+// reattached to, so those are surfaced as STATUS_FAILED recovery jobs).
+//
+// Connections are authenticated at the transport layer by mTLS (see
+// StartResource); per-job RPCs are further authorized by a capability token
+// issued from AddTask, rather than a single shared secret.
+//
+// addTaskRate and addTaskBurst configure the token-bucket limiter guarding
+// AddTask: up to addTaskBurst tasks may be added back to back, refilling at
+// addTaskRate per second after that.
+func NewResourceQueue(stateDir string, addTaskRate float64, addTaskBurst int) (Queue, error) {
+	wal, err := OpenWAL(stateDir)
+	if err != nil {
+		return Queue{}, err
 	}
+
+	recovered, err := replayWAL(stateDir)
+	if err != nil {
+		return Queue{}, err
+	}
+
+	stack := map[string]common.Tasker{}
+	for id, job := range recovered {
+		stack[id] = &recoveredTasker{job: job}
+	}
+
+	return Queue{
+		stack:            stack,
+		tools:            []common.Tooler{},
+		tokens:           NewTokenStore(DefaultTokenTTL),
+		hardware:         map[string]bool{},
+		wal:              wal,
+		drainTimeout:     DefaultDrainTimeout,
+		addTaskLimiter:   ratelimit.NewLimiter(addTaskRate, addTaskBurst),
+		toolSlots:        map[string]*ratelimit.Semaphore{},
+		hardwareSlots:    map[string]*ratelimit.Semaphore{},
+		hardwareCapacity: map[string]int{},
+		jobSlots:         map[string]func(){},
+		events:           newEventHub(),
+		retries:          newRetryState(),
+	}, nil
+}
+
+// SetHardwareCapacity configures how many tasks may run concurrently
+// against a piece of hardware, as identified by the common.Tooler
+// Requirements() string every tool sharing it reports. It must be called
+// before the first AddTool that registers that hardware key: AddTool sizes
+// a hardware's semaphore once, the first time it sees that key, and never
+// reconsiders it afterwards. max <= 0 means unlimited. Hardware with no
+// configured capacity defaults to unlimited rather than borrowing whichever
+// tool happens to register it first.
+func (q *Queue) SetHardwareCapacity(requirements string, max int) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.hardwareCapacity[requirements] = max
+}
+
+// SetDrainTimeout overrides how long Queue.Leave will wait for running jobs
+// to finish before giving up and quitting anyway.
+func (q *Queue) SetDrainTimeout(d time.Duration) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.drainTimeout = d
 }
 
 func (q *Queue) AddTool(tooler common.Tooler) {
@@ -70,39 +193,74 @@ func (q *Queue) AddTool(tooler common.Tooler) {
 
 	tooler.SetUUID(uuid.New())
 	q.tools = append(q.tools, tooler)
+
+	q.toolSlots[tooler.UUID()] = ratelimit.NewSemaphore(tooler.MaxConcurrent())
+
+	// Tools that share a hardware key (e.g. two password crackers both tied
+	// to "gpu0") share a single semaphore so they can't jointly oversubscribe
+	// it even though each is under its own per-tool limit. The cap comes
+	// from hardware-level config (see SetHardwareCapacity), not from
+	// whichever tool happens to register the key first -- that tool's own
+	// MaxConcurrent says nothing about what the hardware itself can run.
+	if _, ok := q.hardwareSlots[tooler.Requirements()]; !ok {
+		q.hardwareSlots[tooler.Requirements()] = ratelimit.NewSemaphore(q.hardwareCapacity[tooler.Requirements()])
+	}
 }
 
 // Task RPC functions
 
 func (q *Queue) ResourceHardware(rpc common.RPCCall, hw *map[string]bool) error {
-	// Check authentication token
-	if rpc.Auth != q.authToken {
-		return errors.New(ERROR_AUTH)
-	}
-
+	// The master's identity is established by its client certificate during
+	// the mTLS handshake, so master-scoped calls no longer check a shared
+	// secret here.
 	q.RLock()
 	defer q.RUnlock()
 
-	*hw = q.hardware
+	// Copy rather than alias q.hardware: the caller gets its own map to do
+	// with as it pleases, instead of a live view into our internal state
+	// guarded only by this already-released RLock.
+	cp := make(map[string]bool, len(q.hardware))
+	for k, v := range q.hardware {
+		cp[k] = v
+	}
+	*hw = cp
 
 	return nil
 }
 
 func (q *Queue) AddTask(rpc common.RPCCall, rj *common.Job) error {
-	// Check authentication token
-	if rpc.Auth != q.authToken {
-		return errors.New(ERROR_AUTH)
+	if q.isLeaving() {
+		return errors.New(ERROR_LEAVING)
+	}
+
+	if ok, retryAfter := q.addTaskLimiter.Reserve(); !ok {
+		return &ErrResourceBusy{Reason: "AddTask rate limit exceeded for this resource.", RetryAfter: retryAfter}
 	}
 
 	// variable to hold the tasker
 	var tasker common.Tasker
 	var err error
+	var toolUUID, hwKey string
 	// loop through common.Toolers for matching tool
 	q.RLock()
 	for i, _ := range q.tools {
 		if q.tools[i].UUID() == rpc.Job.ToolUUID {
-			tasker, err = q.tools[i].NewTask(rpc.Job)
+			toolUUID = q.tools[i].UUID()
+			hwKey = q.tools[i].Requirements()
+
+			// Tools that want to stream progress/stdout/stderr rather than
+			// only being polled via TaskStatus implement eventEmitter; give
+			// them a callback straight into this job's eventHub feed.
+			if emitter, ok := q.tools[i].(eventEmitter); ok {
+				tasker, err = emitter.NewTaskWithEvents(rpc.Job, func(evt common.TaskEvent) {
+					q.events.publish(rpc.Job.UUID, evt)
+				})
+			} else {
+				tasker, err = q.tools[i].NewTask(rpc.Job)
+			}
+
 			if err != nil {
+				q.RUnlock()
 				return err
 			}
 		}
@@ -114,132 +272,265 @@ func (q *Queue) AddTask(rpc common.RPCCall, rj *common.Job) error {
 		return errors.New(ERROR_NO_TOOL)
 	}
 
-	// Looks good so lets add to the stack
+	q.RLock()
+	toolSlot := q.toolSlots[toolUUID]
+	hwSlot := q.hardwareSlots[hwKey]
+	q.RUnlock()
+
+	if !toolSlot.TryAcquire() {
+		return &ErrResourceBusy{Reason: "Tool is already running its maximum number of concurrent tasks.", RetryAfter: time.Second}
+	}
+
+	if !hwSlot.TryAcquire() {
+		toolSlot.Release()
+		return &ErrResourceBusy{Reason: "Hardware required by this tool is already fully committed.", RetryAfter: time.Second}
+	}
+
+	// Looks good so lets add to the stack. Note that the lock is held only
+	// long enough to record the tasker and its release function: starting
+	// the task itself can block on tool I/O and must not be done while
+	// holding the queue lock, or every other RPC stalls behind it.
 	q.Lock()
 	if q.stack == nil {
 		q.stack = make(map[string]common.Tasker)
 	}
 
 	q.stack[rpc.Job.UUID] = tasker
+	q.jobSlots[rpc.Job.UUID] = func() {
+		toolSlot.Release()
+		hwSlot.Release()
+	}
+	q.Unlock()
 
-	// Everything should be paused by the control queue so start this job
-	err = q.stack[rpc.Job.UUID].Run()
-	if err != nil {
+	// Everything should be paused by the control queue so start this job.
+	// A recoverable failure (see common.RecoverableError) doesn't fail the
+	// call outright; it's retried in the background per rpc.Job.RestartPolicy.
+	if err := q.runWithRetry(rpc.Job.UUID, tasker, rpc.Job.RestartPolicy); err != nil {
+		q.Lock()
+		delete(q.stack, rpc.Job.UUID)
+		delete(q.jobSlots, rpc.Job.UUID)
+		q.Unlock()
+
+		toolSlot.Release()
+		hwSlot.Release()
 		return errors.New("Error starting task on the resource: " + err.Error())
 	}
 
 	// Grab the status and return that job to the control queue
-	*rj = q.stack[rpc.Job.UUID].Status()
-	q.Unlock()
+	*rj = tasker.Status()
+
+	// Issue a capability token scoped to this job alone; the master must
+	// present it on every later call for this UUID. This is the only way
+	// in, so a leaked token no longer hands out control of every other job.
+	rj.Token = q.tokens.Issue(rj.UUID, []string{"TaskStatus", "TaskPause", "TaskRun", "TaskQuit", "TaskEvents"})
+
+	log := logrus.WithFields(logrus.Fields{"task": "AddTask", "tool": rpc.Job.ToolUUID, "job_uuid": rj.UUID})
+
+	// The WAL is a plaintext on-disk file replayed on restart; it has no
+	// business holding a live capability token, and replay never restores
+	// one into the TokenStore anyway, so it would just be a leaked secret.
+	walJob := *rj
+	walJob.Token = ""
+	if err := q.wal.append(walEventAddTask, rj.UUID, walJob); err != nil {
+		log.WithError(err).Error("Failed to write AddTask to the write-ahead log")
+	}
+
+	q.events.publish(rj.UUID, common.TaskEvent{UUID: rj.UUID, Type: "added"})
+	q.events.publish(rj.UUID, common.TaskEvent{UUID: rj.UUID, Type: "started"})
+
+	log.Info("Task added and started")
 
 	return nil
 }
 
 func (q *Queue) TaskStatus(rpc common.RPCCall, j *common.Job) error {
-	// Check authentication token
-	if rpc.Auth != q.authToken {
+	// Check that the caller presented a capability token scoped to this
+	// job UUID for this specific method.
+	if !q.tokens.Authorize(rpc.Auth, rpc.Job.UUID, "TaskStatus") {
 		return errors.New(ERROR_AUTH)
 	}
 
-	// Grab the task specified by the UUID and return its status
-	q.Lock()
-	_, ok := q.stack[rpc.Job.UUID]
+	// Grab the task specified by the UUID and return its status. This only
+	// reads from the stack, so an RLock is enough.
+	q.RLock()
+	tasker, ok := q.stack[rpc.Job.UUID]
+	q.RUnlock()
 
-	// Check for a bad UUID
-	if ok != false {
-		errors.New("Task with UUID provided does not exist.")
+	if !ok {
+		return &ErrUnknownJob{UUID: rpc.Job.UUID}
 	}
 
-	*j = q.stack[rpc.Job.UUID].Status()
-
-	q.Unlock()
+	*j = tasker.Status()
 
 	return nil
 }
 
 func (q *Queue) TaskPause(rpc common.RPCCall, j *common.Job) error {
-	// Check authentication token
-	if rpc.Auth != q.authToken {
+	// Check that the caller presented a capability token scoped to this
+	// job UUID for this specific method.
+	if !q.tokens.Authorize(rpc.Auth, rpc.Job.UUID, "TaskPause") {
 		return errors.New(ERROR_AUTH)
 	}
 
-	// Grab the task specified by the UUID
-	q.Lock()
-	_, ok := q.stack[rpc.Job.UUID]
+	// Grab the task specified by the UUID. Pause may block on tool I/O, so
+	// the lock is released before we call into the tasker.
+	q.RLock()
+	tasker, ok := q.stack[rpc.Job.UUID]
+	q.RUnlock()
 
-	// Check for a bad UUID
-	if ok {
-		errors.New("Task with UUID provided does not exist.")
+	if !ok {
+		return &ErrUnknownJob{UUID: rpc.Job.UUID}
 	}
 
 	// Pause the task
-	err := q.stack[rpc.Job.UUID].Pause()
+	err := tasker.Pause()
 	if err != nil {
 		// return the error but quit the job with status Failed
 		// This is a definied behavior that we will not for all tools
-		q.stack[rpc.Job.UUID].Quit()
+		tasker.Quit()
 		return err
 	}
 
-	*j = q.stack[rpc.Job.UUID].Status()
-	q.Unlock()
+	*j = tasker.Status()
+
+	log := logrus.WithFields(logrus.Fields{"task": "TaskPause", "job_uuid": j.UUID})
+
+	if err := q.wal.append(walEventTaskPause, j.UUID, *j); err != nil {
+		log.WithError(err).Error("Failed to write TaskPause to the write-ahead log")
+	}
+
+	q.events.publish(j.UUID, common.TaskEvent{UUID: j.UUID, Type: "paused"})
+	log.Info("Task paused")
 
 	return nil
 }
 
 func (q *Queue) TaskRun(rpc common.RPCCall, j *common.Job) error {
-	// Check authentication token
-	if rpc.Auth != q.authToken {
+	// Check that the caller presented a capability token scoped to this
+	// job UUID for this specific method.
+	if !q.tokens.Authorize(rpc.Auth, rpc.Job.UUID, "TaskRun") {
 		return errors.New(ERROR_AUTH)
 	}
 
-	// Grab the task specified by the UUID
-	q.Lock()
-	_, ok := q.stack[rpc.Job.UUID]
+	// Grab the task specified by the UUID. Starting it may block on tool
+	// I/O, so the lock is released before we call into the tasker.
+	q.RLock()
+	tasker, ok := q.stack[rpc.Job.UUID]
+	q.RUnlock()
 
-	// Check for a bad UUID
-	if ok != false {
-		errors.New("Task with UUID provided does not exist.")
+	if !ok {
+		return &ErrUnknownJob{UUID: rpc.Job.UUID}
 	}
 
-	// Start or resume the task
-	err := q.stack[rpc.Job.UUID].Run()
-	if err != nil {
+	// Start or resume the task, retrying recoverable failures in the
+	// background per rpc.Job.RestartPolicy rather than failing outright.
+	if err := q.runWithRetry(rpc.Job.UUID, tasker, rpc.Job.RestartPolicy); err != nil {
 		return err
 	}
 
-	*j = q.stack[rpc.Job.UUID].Status()
-	q.Unlock()
+	*j = tasker.Status()
+
+	log := logrus.WithFields(logrus.Fields{"task": "TaskRun", "job_uuid": j.UUID})
+
+	if err := q.wal.append(walEventTaskRun, j.UUID, *j); err != nil {
+		log.WithError(err).Error("Failed to write TaskRun to the write-ahead log")
+	}
+
+	q.events.publish(j.UUID, common.TaskEvent{UUID: j.UUID, Type: "started"})
+	log.Info("Task started")
 
 	return nil
 
 }
 
 func (q *Queue) TaskQuit(rpc common.RPCCall, j *common.Job) error {
-	// Check authentication token
-	if rpc.Auth != q.authToken {
+	// Check that the caller presented a capability token scoped to this
+	// job UUID for this specific method.
+	if !q.tokens.Authorize(rpc.Auth, rpc.Job.UUID, "TaskQuit") {
 		return errors.New(ERROR_AUTH)
 	}
 
-	// Grab the task specified by the UUID
-	q.Lock()
-	_, ok := q.stack[rpc.Job.UUID]
+	// Grab the task specified by the UUID. Quit may block on tool I/O, so
+	// the lock is released before we call into the tasker.
+	q.RLock()
+	tasker, ok := q.stack[rpc.Job.UUID]
+	q.RUnlock()
 
-	// Check for a bad UUID
-	if ok != false {
-		errors.New("Task with UUID provided does not exist.")
+	if !ok {
+		return &ErrUnknownJob{UUID: rpc.Job.UUID}
 	}
 
 	// Quit the task and return the final result
-	*j = q.stack[rpc.Job.UUID].Quit()
+	*j = tasker.Quit()
 
+	q.Lock()
 	// Remove quit job from stack
 	delete(q.stack, rpc.Job.UUID)
+
+	// Give back the tool/hardware concurrency slots this job was holding.
+	if release, ok := q.jobSlots[rpc.Job.UUID]; ok {
+		release()
+		delete(q.jobSlots, rpc.Job.UUID)
+	}
+	q.retries.clear(rpc.Job.UUID)
 	q.Unlock()
 
+	log := logrus.WithFields(logrus.Fields{"task": "TaskQuit", "job_uuid": j.UUID})
+
+	if err := q.wal.append(walEventTaskQuit, j.UUID, *j); err != nil {
+		log.WithError(err).Error("Failed to write TaskQuit to the write-ahead log")
+	}
+
+	q.events.publish(j.UUID, common.TaskEvent{UUID: j.UUID, Type: "finished"})
+	log.Info("Task quit")
+
+	// The job is gone, so the token that scoped access to it no longer
+	// authorizes anything; drop it rather than letting it linger until TTL.
+	q.tokens.Revoke(rpc.Auth)
+
 	return nil
 }
 
+// TaskEvents replaces polling TaskStatus in a loop: it subscribes to the
+// given job's lifecycle events (added, started, paused, progress, stdout/
+// stderr lines, finished, failed) and returns as soon as at least one is
+// available, together with any others already queued, or with no events
+// once 30 seconds pass without one arriving.
+// Internally this is a fan-out hub (see eventHub) that tool implementations
+// and the queue itself publish into; disconnected subscribers are dropped
+// the next time a publish can't keep up with them.
+func (q *Queue) TaskEvents(rpc common.RPCCall, stream *common.EventStream) error {
+	if !q.tokens.Authorize(rpc.Auth, rpc.Job.UUID, "TaskEvents") {
+		return errors.New(ERROR_AUTH)
+	}
+
+	sub := q.events.subscribe(rpc.Job.UUID)
+	defer q.events.unsubscribe(rpc.Job.UUID, sub)
+
+	select {
+	case evt, ok := <-sub:
+		if ok {
+			stream.Events = append(stream.Events, evt)
+		}
+	case <-time.After(30 * time.Second):
+		return nil
+	}
+
+	// Opportunistically drain anything else already queued up without
+	// blocking, so one call can carry more than a single event.
+	for {
+		select {
+		case evt, ok := <-sub:
+			if !ok {
+				return nil
+			}
+			stream.Events = append(stream.Events, evt)
+		default:
+			return nil
+		}
+	}
+}
+
 // Queue Tasks
 
 func (q *Queue) ResourceTools(rpc common.RPCCall, tools *[]common.Tool) error {
@@ -265,17 +556,95 @@ func (q *Queue) ResourceTools(rpc common.RPCCall, tools *[]common.Tool) error {
 	return nil
 }
 
-func (q *Queue) AllTaskStatus(rpc common.RPCCall, j *[]common.Job) error {
-	// Check authentication token
-	if rpc.Auth != q.authToken {
-		return errors.New(ERROR_AUTH)
+// Leave tells the resource to stop accepting new tasks and begin draining
+// its currently running jobs. Once draining completes, or q.drainTimeout
+// elapses, StartResource closes its listener and the resource process can
+// exit. Leave is safe to call more than once or from multiple masters.
+func (q *Queue) Leave(rpc common.RPCCall, _ *bool) error {
+	q.beginLeave()
+
+	return nil
+}
+
+// ResourcePing is a lightweight heartbeat RPC the master can use to detect
+// a resource that has gone stale (e.g. the TCP connection is half-open).
+func (q *Queue) ResourcePing(rpc common.RPCCall, alive *bool) error {
+	*alive = true
+
+	return nil
+}
+
+// isLeaving reports whether the resource has started its leave/drain
+// sequence and should refuse any new work.
+func (q *Queue) isLeaving() bool {
+	q.RLock()
+	defer q.RUnlock()
+
+	return q.leaving
+}
+
+// beginLeave flips the queue into leaving mode and kicks off the drain
+// goroutine exactly once.
+func (q *Queue) beginLeave() {
+	q.Lock()
+	if q.leaving {
+		q.Unlock()
+		return
+	}
+	q.leaving = true
+	q.Unlock()
+
+	go q.drain()
+}
+
+// drain waits until every live job has been taken off the stack (by
+// TaskQuit, or by failJob once its retries run out), up to drainTimeout,
+// then closes q.left so StartResource can stop the listener and let the
+// process quit. A job whose tool has finished but which has not been quit
+// still counts as live.
+func (q *Queue) drain() {
+	deadline := time.Now().Add(q.drainTimeout)
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if q.stackEmpty() || time.Now().After(deadline) {
+			close(q.left)
+			return
+		}
+
+		<-ticker.C
+	}
+}
+
+// stackEmpty reports whether any live jobs remain on the queue's stack.
+// Jobs recovered from the WAL after a crash (see recoveredTasker) are
+// already terminal and can never be quit through the normal RPC path -- no
+// capability token was ever issued for them, since tokens aren't persisted
+// -- so they would otherwise sit on the stack forever and block drain()
+// from ever finishing. They don't count as live.
+func (q *Queue) stackEmpty() bool {
+	q.RLock()
+	defer q.RUnlock()
+
+	for _, tasker := range q.stack {
+		if _, recovered := tasker.(*recoveredTasker); !recovered {
+			return false
+		}
 	}
 
+	return true
+}
+
+func (q *Queue) AllTaskStatus(rpc common.RPCCall, j *[]common.Job) error {
 	// Loop through any tasks in the stack and update their status while
-	// grabing the Job object output
+	// grabing the Job object output. This only reads from the stack, so an
+	// RLock is enough -- it used to take the write Lock for no reason,
+	// serializing every other call behind a full status sweep.
 	var jobs []common.Job
 
-	q.Lock()
+	q.RLock()
+	defer q.RUnlock()
 
 	for i, _ := range q.stack {
 		jobs = append(jobs, q.stack[i].Status())
@@ -283,7 +652,5 @@ func (q *Queue) AllTaskStatus(rpc common.RPCCall, j *[]common.Job) error {
 
 	*j = jobs
 
-	q.Unlock()
-
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,200 @@
+package resource
+
+import (
+	"fmt"
+	"github.com/jmmcatee/cracklord/common"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+// mockTasker is a common.Tasker test double that just tracks status
+// transitions in memory, with no real tool process behind it.
+type mockTasker struct {
+	sync.Mutex
+	job common.Job
+}
+
+func (t *mockTasker) Run() error {
+	t.Lock()
+	defer t.Unlock()
+
+	t.job.Status = common.STATUS_RUNNING
+	return nil
+}
+
+func (t *mockTasker) Pause() error {
+	t.Lock()
+	defer t.Unlock()
+
+	t.job.Status = common.STATUS_PAUSED
+	return nil
+}
+
+func (t *mockTasker) Quit() common.Job {
+	t.Lock()
+	defer t.Unlock()
+
+	t.job.Status = common.STATUS_DONE
+	return t.job
+}
+
+func (t *mockTasker) Status() common.Job {
+	t.Lock()
+	defer t.Unlock()
+
+	return t.job
+}
+
+// mockTooler is a common.Tooler test double that hands out mockTaskers.
+type mockTooler struct {
+	uuid         string
+	maxConcur    int
+	requirements string
+}
+
+func (t *mockTooler) UUID() string         { return t.uuid }
+func (t *mockTooler) SetUUID(u string)     { t.uuid = u }
+func (t *mockTooler) Name() string         { return "mock" }
+func (t *mockTooler) Type() string         { return "mock" }
+func (t *mockTooler) Version() string      { return "1.0" }
+func (t *mockTooler) Requirements() string { return t.requirements }
+func (t *mockTooler) MaxConcurrent() int   { return t.maxConcur }
+func (t *mockTooler) Parameters() []common.Parameter {
+	return nil
+}
+
+func (t *mockTooler) NewTask(job common.Job) (common.Tasker, error) {
+	return &mockTasker{job: job}, nil
+}
+
+func newTestQueue(t *testing.T) (Queue, func()) {
+	dir, err := ioutil.TempDir("", "cracklord-resource-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := NewResourceQueue(dir, 1000, 1000)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	q.AddTool(&mockTooler{maxConcur: 100, requirements: "cpu"})
+
+	return q, func() { os.RemoveAll(dir) }
+}
+
+// TestAddTaskQuitAllStatusRace hammers AddTask, TaskQuit and AllTaskStatus
+// concurrently from many goroutines. Run with -race: it exercises the three
+// code paths the lock-scope fixes in this package targeted (AddTask no
+// longer holds the queue lock across Tasker.Run, TaskQuit releases its
+// slots under the right lock, AllTaskStatus only takes an RLock).
+func TestAddTaskQuitAllStatusRace(t *testing.T) {
+	q, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	var toolUUID string
+	for _, tool := range q.tools {
+		toolUUID = tool.UUID()
+	}
+
+	const n = 50
+	var wg sync.WaitGroup
+	wg.Add(n)
+
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+
+			jobUUID := fmt.Sprintf("job-%d", i)
+
+			var job common.Job
+			err := q.AddTask(common.RPCCall{Job: common.Job{UUID: jobUUID, ToolUUID: toolUUID}}, &job)
+			if err != nil {
+				t.Errorf("AddTask(%s): %v", jobUUID, err)
+				return
+			}
+
+			var status []common.Job
+			if err := q.AllTaskStatus(common.RPCCall{}, &status); err != nil {
+				t.Errorf("AllTaskStatus: %v", err)
+			}
+
+			var quit common.Job
+			err = q.TaskQuit(common.RPCCall{Auth: job.Token, Job: common.Job{UUID: jobUUID}}, &quit)
+			if err != nil {
+				t.Errorf("TaskQuit(%s): %v", jobUUID, err)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	var status []common.Job
+	if err := q.AllTaskStatus(common.RPCCall{}, &status); err != nil {
+		t.Fatalf("AllTaskStatus: %v", err)
+	}
+	if len(status) != 0 {
+		t.Fatalf("expected every job to be quit, got %d left on the stack", len(status))
+	}
+}
+
+// TestTaskStatusUnknownUUID makes sure a bad UUID returns ErrUnknownJob
+// instead of panicking on a nil-map dereference.
+//
+// Under the capability model, TaskStatus checks the token before ever
+// looking at the stack, so an unauthorized caller (e.g. no token at all)
+// never reaches the ErrUnknownJob branch -- it fails on ERROR_AUTH first.
+// A caller holding a still-valid token can only miss the stack in the
+// narrow window TaskQuit (or failJob) leaves between deleting the job off
+// q.stack and revoking its token, so that's the path this test recreates.
+func TestTaskStatusUnknownUUID(t *testing.T) {
+	q, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	var toolUUID string
+	for _, tool := range q.tools {
+		toolUUID = tool.UUID()
+	}
+
+	jobUUID := "race-job"
+	var job common.Job
+	if err := q.AddTask(common.RPCCall{Job: common.Job{UUID: jobUUID, ToolUUID: toolUUID}}, &job); err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+
+	q.Lock()
+	delete(q.stack, jobUUID)
+	q.Unlock()
+
+	var status common.Job
+	err := q.TaskStatus(common.RPCCall{Auth: job.Token, Job: common.Job{UUID: jobUUID}}, &status)
+	if _, ok := err.(*ErrUnknownJob); !ok {
+		t.Fatalf("expected *ErrUnknownJob, got %#v", err)
+	}
+}
+
+// TestResourceHardwareIsolation confirms the map returned to callers is a
+// copy: mutating it must not corrupt the queue's internal hardware map.
+func TestResourceHardwareIsolation(t *testing.T) {
+	q, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	var hw map[string]bool
+	if err := q.ResourceHardware(common.RPCCall{}, &hw); err != nil {
+		t.Fatal(err)
+	}
+
+	hw["tampered"] = true
+
+	var hw2 map[string]bool
+	if err := q.ResourceHardware(common.RPCCall{}, &hw2); err != nil {
+		t.Fatal(err)
+	}
+
+	if hw2["tampered"] {
+		t.Fatal("mutating the returned hardware map leaked back into the queue")
+	}
+}
@@ -0,0 +1,185 @@
+package resource
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/jmmcatee/cracklord/common"
+	"sync"
+	"time"
+)
+
+// retryState tracks how many times the queue has retried a job's tasker
+// after a recoverable failure, so RestartPolicy.Attempts can be enforced
+// per job UUID.
+type retryState struct {
+	sync.Mutex
+	attempts map[string]int
+}
+
+func newRetryState() *retryState {
+	return &retryState{attempts: map[string]int{}}
+}
+
+func (r *retryState) increment(jobUUID string) int {
+	r.Lock()
+	defer r.Unlock()
+
+	r.attempts[jobUUID]++
+	return r.attempts[jobUUID]
+}
+
+func (r *retryState) clear(jobUUID string) {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.attempts, jobUUID)
+}
+
+// minRetryBackoff is the smallest delay backoffFor will ever return for a
+// policy that actually retries, so a RestartDelay/RestartExponential policy
+// left with MaxDelay unset can't turn into a zero-delay hot loop.
+const minRetryBackoff = time.Second
+
+// backoffFor computes how long to wait before the next retry attempt,
+// given how many attempts of policy have already been made. It is never
+// called for common.RestartFail: runWithRetry fails those out immediately.
+func backoffFor(policy common.RestartPolicy, attempt int) time.Duration {
+	max := policy.MaxDelay
+	if max < minRetryBackoff {
+		max = minRetryBackoff
+	}
+
+	switch policy.Mode {
+	case common.RestartDelay:
+		return max
+	case common.RestartExponential:
+		delay := minRetryBackoff
+		for i := 0; i < attempt; i++ {
+			delay *= 2
+			if delay >= max {
+				return max
+			}
+		}
+		return delay
+	default:
+		return max
+	}
+}
+
+// isRecoverable reports whether err is a common.RecoverableError marked as
+// recoverable; any other error (including a non-recoverable
+// common.RecoverableError) is treated as fatal. Tools classify their own
+// failures and are not required to hand back a pointer, so both the
+// pointer and value forms are accepted.
+func isRecoverable(err error) bool {
+	switch e := err.(type) {
+	case *common.RecoverableError:
+		return e.Recoverable
+	case common.RecoverableError:
+		return e.Recoverable
+	default:
+		return false
+	}
+}
+
+// runWithRetry runs tasker and, if it fails with a recoverable error and
+// policy still allows another attempt, schedules a retry in the background
+// after the policy's backoff instead of failing the call outright. A
+// non-recoverable error, or a recoverable one with no attempts left, is
+// returned as-is so the caller fails the job immediately.
+func (q *Queue) runWithRetry(jobUUID string, tasker common.Tasker, policy common.RestartPolicy) error {
+	err := tasker.Run()
+	if err == nil {
+		q.retries.clear(jobUUID)
+		return nil
+	}
+
+	if !isRecoverable(err) {
+		return err
+	}
+
+	// RestartFail means exactly that: never retry, no matter how the rest
+	// of policy is set.
+	if policy.Mode == common.RestartFail {
+		return err
+	}
+
+	attempt := q.retries.increment(jobUUID)
+	if policy.Attempts > 0 && attempt >= policy.Attempts {
+		return err
+	}
+
+	delay := backoffFor(policy, attempt)
+
+	logrus.WithFields(logrus.Fields{"task": "RetryTask", "job_uuid": jobUUID}).
+		WithError(err).
+		Infof("Recoverable failure, retrying in %s (attempt %d)", delay, attempt)
+
+	go q.scheduleRetry(jobUUID, tasker, policy, delay)
+
+	return nil
+}
+
+// scheduleRetry waits out delay, confirms the job hasn't been quit out from
+// under it in the meantime, then tries running tasker again.
+func (q *Queue) scheduleRetry(jobUUID string, tasker common.Tasker, policy common.RestartPolicy, delay time.Duration) {
+	time.Sleep(delay)
+
+	q.RLock()
+	_, stillQueued := q.stack[jobUUID]
+	q.RUnlock()
+	if !stillQueued {
+		return
+	}
+
+	if err := q.runWithRetry(jobUUID, tasker, policy); err != nil {
+		q.failJob(jobUUID, tasker, err)
+		return
+	}
+
+	// This status transition didn't come through one of the RPC-driven
+	// paths (AddTask, TaskPause, TaskRun, TaskQuit) that already journal
+	// themselves, so it has to be recorded here or a crash between now and
+	// the next explicit RPC would replay the job back to its pre-retry
+	// state instead of the one it actually resumed in.
+	status := tasker.Status()
+	log := logrus.WithFields(logrus.Fields{"task": "RetryTask", "job_uuid": jobUUID})
+	if err := q.wal.append(walEventStatus, jobUUID, status); err != nil {
+		log.WithError(err).Error("Failed to write retry status to the write-ahead log")
+	}
+
+	q.events.publish(jobUUID, common.TaskEvent{UUID: jobUUID, Type: "started"})
+}
+
+// failJob tears down a job that has exhausted its restart policy in the
+// background, long after AddTask/TaskRun already returned success to the
+// master. Nobody is blocked on an RPC waiting for this, so it has to do the
+// same cleanup TaskQuit does on its own: release the tool/hardware slots,
+// drop the job off the stack, and tell whoever is still watching.
+func (q *Queue) failJob(jobUUID string, tasker common.Tasker, cause error) {
+	job := tasker.Quit()
+	job.Status = common.STATUS_FAILED
+	job.StatusMessage = cause.Error()
+
+	q.Lock()
+	delete(q.stack, jobUUID)
+	if release, ok := q.jobSlots[jobUUID]; ok {
+		release()
+		delete(q.jobSlots, jobUUID)
+	}
+	q.retries.clear(jobUUID)
+	q.Unlock()
+
+	log := logrus.WithFields(logrus.Fields{"task": "RetryTask", "job_uuid": jobUUID})
+
+	if err := q.wal.append(walEventTaskQuit, jobUUID, job); err != nil {
+		log.WithError(err).Error("Failed to write terminal retry failure to the write-ahead log")
+	}
+
+	q.events.publish(jobUUID, common.TaskEvent{UUID: jobUUID, Type: "failed"})
+
+	// Nobody is ever coming back to quit this job through the normal RPC
+	// path, so its token has to be revoked here instead of by TaskQuit.
+	q.tokens.RevokeForJob(jobUUID)
+
+	log.WithError(cause).Error("Task failed after exhausting its restart policy")
+}
@@ -0,0 +1,115 @@
+package resource
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"sync"
+	"time"
+)
+
+// DefaultTokenTTL is how long a capability token issued by AddTask remains
+// valid. Short-lived on purpose: a token leaking is far less damaging than
+// the single long-lived master secret it replaces.
+const DefaultTokenTTL = 15 * time.Minute
+
+// scopedToken grants whoever holds it the right to call a specific set of
+// RPC methods against a single job UUID, until it expires.
+type scopedToken struct {
+	uuid    string
+	methods map[string]bool
+	expires time.Time
+}
+
+// TokenStore issues and checks the capability tokens that guard task-level
+// RPCs (TaskStatus, TaskPause, TaskRun, TaskQuit). It replaces the single
+// shared authToken string that used to authorize every call against every
+// job on the resource.
+type TokenStore struct {
+	sync.RWMutex
+	tokens map[string]scopedToken
+	ttl    time.Duration
+}
+
+// NewTokenStore creates an empty TokenStore whose issued tokens are valid
+// for ttl.
+func NewTokenStore(ttl time.Duration) *TokenStore {
+	return &TokenStore{
+		tokens: map[string]scopedToken{},
+		ttl:    ttl,
+	}
+}
+
+// Issue mints a new token scoped to jobUUID that authorizes only the given
+// RPC method names.
+func (t *TokenStore) Issue(jobUUID string, methods []string) string {
+	t.Lock()
+	defer t.Unlock()
+
+	allowed := map[string]bool{}
+	for _, m := range methods {
+		allowed[m] = true
+	}
+
+	token := uuid.New()
+	t.tokens[token] = scopedToken{
+		uuid:    jobUUID,
+		methods: allowed,
+		expires: time.Now().Add(t.ttl),
+	}
+
+	return token
+}
+
+// Authorize reports whether token grants access to method on jobUUID and
+// has not yet expired. A successful check slides the token's expiry
+// forward by another full TTL: cracking jobs routinely run far longer than
+// DefaultTokenTTL, so a token that is still being actively used to manage
+// its job (status polling, pause/run, TaskEvents) must never expire out
+// from under it. Only a token nobody presents for a whole TTL window -- a
+// master that vanished, or a job nobody is watching -- actually lapses.
+func (t *TokenStore) Authorize(token string, jobUUID string, method string) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	scoped, ok := t.tokens[token]
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(scoped.expires) {
+		delete(t.tokens, token)
+		return false
+	}
+
+	if scoped.uuid != jobUUID || !scoped.methods[method] {
+		return false
+	}
+
+	scoped.expires = time.Now().Add(t.ttl)
+	t.tokens[token] = scoped
+
+	return true
+}
+
+// Revoke removes a token immediately, e.g. once its job has been quit and
+// the token no longer has anything left to authorize.
+func (t *TokenStore) Revoke(token string) {
+	t.Lock()
+	defer t.Unlock()
+
+	delete(t.tokens, token)
+}
+
+// RevokeForJob removes every token scoped to jobUUID. It exists for the
+// paths that fail a job in the background (a retry that exhausts its
+// restart policy) where nobody is ever going to call Quit with the token in
+// hand to revoke it the normal way.
+func (t *TokenStore) RevokeForJob(jobUUID string) {
+	t.Lock()
+	defer t.Unlock()
+
+	for token, scoped := range t.tokens {
+		if scoped.uuid == jobUUID {
+			delete(t.tokens, token)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package resource
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jmmcatee/cracklord/common"
+)
+
+// Event kinds recorded in the write-ahead log. Each one records a change to
+// a job on q.stack; replayWAL acts on ADD_TASK, STATUS and TASK_QUIT, while
+// TASK_PAUSE and TASK_RUN entries are recorded but not used during replay.
+const (
+	walEventAddTask   = "ADD_TASK"
+	walEventStatus    = "STATUS"
+	walEventTaskPause = "TASK_PAUSE"
+	walEventTaskRun   = "TASK_RUN"
+	walEventTaskQuit  = "TASK_QUIT"
+)
+
+// walEntry is a single line in the on-disk log. Every entry carries the
+// job's state as of the event in Job; replay reads Job from AddTask and
+// Status entries and only the UUID from Quit entries.
+type walEntry struct {
+	Time  time.Time  `json:"time"`
+	Event string     `json:"event"`
+	UUID  string     `json:"uuid"`
+	Job   common.Job `json:"job,omitempty"`
+}
+
+// WAL is a simple append-only JSON log used to make a Queue's in-memory
+// stack durable across resource process restarts. It is intentionally not a
+// general purpose database: entries are only ever appended, and the log is
+// fully replayed into memory on startup.
+type WAL struct {
+	sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// OpenWAL opens (creating if necessary) the write-ahead log file inside
+// dir. The directory is created if it does not already exist.
+func OpenWAL(dir string) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, "queue.wal"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WAL{
+		file: f,
+		enc:  json.NewEncoder(f),
+	}, nil
+}
+
+// append writes a single entry to the log and flushes it to disk. It holds
+// w.Lock for the duration of the write so entries never interleave.
+func (w *WAL) append(event string, uuid string, job common.Job) error {
+	w.Lock()
+	defer w.Unlock()
+
+	entry := walEntry{
+		Time:  time.Now(),
+		Event: event,
+		UUID:  uuid,
+		Job:   job,
+	}
+
+	if err := w.enc.Encode(&entry); err != nil {
+		return err
+	}
+
+	return w.file.Sync()
+}
+
+func (w *WAL) Close() error {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.file.Close()
+}
+
+// replayWAL reads every entry out of the log at dir and folds them into a
+// map of common.Job keyed by job UUID. It does not attempt to resurrect a
+// running Tasker -- a tool process that was running when the resource died
+// cannot, in general, be re-attached to, so every job that was not cleanly
+// quit before the crash is handed back with STATUS_FAILED and a recovery
+// reason explaining why.
+func replayWAL(dir string) (map[string]common.Job, error) {
+	recovered := map[string]common.Job{}
+
+	path := filepath.Join(dir, "queue.wal")
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return recovered, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var entry walEntry
+		if err := dec.Decode(&entry); err != nil {
+			break
+		}
+
+		switch entry.Event {
+		case walEventAddTask, walEventStatus:
+			recovered[entry.UUID] = entry.Job
+		case walEventTaskQuit:
+			delete(recovered, entry.UUID)
+		}
+	}
+
+	// Anything left in the map was still on the stack when this process
+	// died, so it never reached a TaskQuit entry. We cannot reattach to the
+	// underlying tool process, so mark it failed and explain why.
+	for id, job := range recovered {
+		job.Status = common.STATUS_FAILED
+		job.StatusMessage = "Resource restarted and lost contact with this job; marked failed during WAL recovery."
+		recovered[id] = job
+	}
+
+	return recovered, nil
+}
+
+// recoveredTasker is a placeholder common.Tasker used to populate q.stack
+// for jobs recovered from the WAL that could not be reattached to a live
+// tool process. It simply reports the terminal state recorded at recovery
+// time; Run/Pause are no-ops returning errRecoveredJob since there is
+// nothing left to control.
+type recoveredTasker struct {
+	job common.Job
+}
+
+func (r *recoveredTasker) Run() error {
+	return errRecoveredJob
+}
+
+func (r *recoveredTasker) Pause() error {
+	return errRecoveredJob
+}
+
+func (r *recoveredTasker) Quit() common.Job {
+	return r.job
+}
+
+func (r *recoveredTasker) Status() common.Job {
+	return r.job
+}